@@ -0,0 +1,156 @@
+package zaprollbar
+
+import (
+	"fmt"
+	"hash/adler32"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// causer is pkg/errors' wrapping interface.
+type causer interface {
+	Cause() error
+}
+
+// unwrapper is the standard library's Go 1.13 wrapping interface.
+type unwrapper interface {
+	Unwrap() error
+}
+
+// joinUnwrapper is the errors.Join wrapping interface.
+type joinUnwrapper interface {
+	Unwrap() []error
+}
+
+// unwrapOnce returns err's immediate cause(s), trying errors.Join's
+// multi-error Unwrap, then errors.Unwrap, then pkg/errors' Cause. next is the
+// single next error in the chain, or joined holds every branch of a joined
+// error; at most one of the two is populated.
+func unwrapOnce(err error) (next error, joined []error) {
+	if j, ok := err.(joinUnwrapper); ok {
+		return nil, j.Unwrap()
+	}
+	if u, ok := err.(unwrapper); ok {
+		return u.Unwrap(), nil
+	}
+	if c, ok := err.(causer); ok {
+		return c.Cause(), nil
+	}
+	return nil, nil
+}
+
+func getTrace(err error) map[string]interface{} {
+	type stackTracer interface {
+		StackTrace() errors.StackTrace
+	}
+
+	frames := []map[string]interface{}{}
+	if tracer, ok := err.(stackTracer); ok {
+		stack := tracer.StackTrace()
+		frames = make([]map[string]interface{}, len(stack))
+		for n, frame := range stack {
+			lineno, _ := strconv.Atoi(fmt.Sprintf("%d", frame)) // use zero on failure
+			methodFmt := "%n"                                   // broken out to trick govet
+			frames[n] = map[string]interface{}{
+				"filename": fmt.Sprintf("%s", frame),
+				"lineno":   lineno,
+				"method":   fmt.Sprintf(methodFmt, frame),
+			}
+		}
+	}
+	return map[string]interface{}{
+		"frames": frames,
+		"exception": map[string]interface{}{
+			"class":   getErrorClass(err),
+			"message": err.Error(),
+		},
+	}
+}
+
+func getErrorClass(err error) string {
+	class := reflect.TypeOf(err).String()
+	if class == "" {
+		return "panic"
+	} else if class == "*errors.errorString" || class == "*errors.fundamental" {
+		checksum := adler32.Checksum([]byte(err.Error()))
+		return fmt.Sprintf("{%x}", checksum)
+	}
+	return strings.TrimPrefix(class, "*")
+}
+
+// getTraceChain returns the primary trace_chain for err: one entry per hop,
+// following pkg/errors' Cause, %w-style Unwrap, and (taking the first
+// branch) errors.Join. Use getTraceChains to see every branch of a joined
+// error.
+func getTraceChain(err error) []map[string]interface{} {
+	chains := getTraceChains(err)
+	if len(chains) == 0 {
+		return []map[string]interface{}{}
+	}
+	return chains[0]
+}
+
+// getTraceChains walks err's full cause tree and returns one trace_chain per
+// root cause, so errors built with errors.Join surface a branch per joined
+// error instead of silently collapsing to the first one.
+func getTraceChains(err error) [][]map[string]interface{} {
+	if err == nil {
+		return nil
+	}
+
+	hop := getTrace(err)
+	next, joined := unwrapOnce(err)
+
+	if len(joined) > 0 {
+		var branches [][]map[string]interface{}
+		for _, j := range joined {
+			for _, sub := range getTraceChains(j) {
+				branches = append(branches, append([]map[string]interface{}{hop}, sub...))
+			}
+		}
+		if len(branches) == 0 {
+			branches = [][]map[string]interface{}{{hop}}
+		}
+		return branches
+	}
+
+	if next == nil {
+		return [][]map[string]interface{}{{hop}}
+	}
+	rest := getTraceChains(next)
+	chains := make([][]map[string]interface{}, len(rest))
+	for i, r := range rest {
+		chains[i] = append([]map[string]interface{}{hop}, r...)
+	}
+	return chains
+}
+
+// fingerprint derives a stable grouping key for err from its deepest stack
+// frame and root error class, so distinct wrappers of the same underlying
+// bug group together in the Rollbar UI instead of splitting by wrapper type.
+func fingerprint(err error) string {
+	chains := getTraceChains(err)
+	if len(chains) == 0 {
+		return ""
+	}
+	chain := chains[0]
+	root := chain[len(chain)-1]
+
+	rootClass, _ := root["exception"].(map[string]interface{})["class"].(string)
+
+	var deepestFrame string
+	for i := len(chain) - 1; i >= 0; i-- {
+		frames, _ := chain[i]["frames"].([]map[string]interface{})
+		if len(frames) == 0 {
+			continue
+		}
+		f := frames[0] // pkg/errors stacks list the innermost call first
+		deepestFrame = fmt.Sprintf("%v:%v", f["filename"], f["lineno"])
+		break
+	}
+
+	return fmt.Sprintf("%x", adler32.Checksum([]byte(rootClass+deepestFrame)))
+}
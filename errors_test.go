@@ -0,0 +1,74 @@
+package zaprollbar
+
+import (
+	"testing"
+
+	stderrors "errors"
+
+	"github.com/pkg/errors"
+)
+
+func TestGetTraceChainFollowsPkgErrorsCause(t *testing.T) {
+	root := errors.New("root cause")
+	wrapped := errors.Wrap(root, "wrapped")
+
+	chain := getTraceChain(wrapped)
+	if len(chain) < 2 {
+		t.Fatalf("expected errors.Wrap's cause chain to produce multiple hops, got %d: %v", len(chain), chain)
+	}
+	last := chain[len(chain)-1]
+	rootClass, _ := last["exception"].(map[string]interface{})["class"].(string)
+	if rootClass == "" {
+		t.Fatalf("expected the root hop to carry an exception class, got %v", last)
+	}
+}
+
+func TestGetTraceChainsSplitsJoinedErrors(t *testing.T) {
+	err := stderrors.Join(stderrors.New("first"), stderrors.New("second"))
+
+	chains := getTraceChains(err)
+	if len(chains) != 2 {
+		t.Fatalf("expected errors.Join to produce 2 branches, got %d", len(chains))
+	}
+}
+
+func TestFingerprintGroupsSameRootClass(t *testing.T) {
+	root := errors.New("boom")
+	a := fingerprint(errors.Wrap(root, "context a"))
+	b := fingerprint(errors.Wrap(root, "context b"))
+
+	if a != b {
+		t.Fatalf("expected two wrappers of the same root error to share a fingerprint, got %q and %q", a, b)
+	}
+	if a == "" {
+		t.Fatal("expected a non-empty fingerprint")
+	}
+}
+
+func TestFingerprintDiffersAcrossRootErrors(t *testing.T) {
+	a := fingerprint(errors.New("boom one"))
+	b := fingerprint(errors.New("boom two"))
+
+	if a == b {
+		t.Fatalf("expected distinct root errors to get distinct fingerprints, both got %q", a)
+	}
+}
+
+func TestGetErrorClassUsesChecksumForPlainErrors(t *testing.T) {
+	class := getErrorClass(stderrors.New("plain"))
+	if class == "" || class[0] != '{' {
+		t.Fatalf("expected a checksum-style class for *errors.errorString, got %q", class)
+	}
+}
+
+type customError struct{ msg string }
+
+func (e *customError) Error() string { return e.msg }
+
+func TestGetErrorClassUsesTypeNameForCustomTypes(t *testing.T) {
+	class := getErrorClass(&customError{msg: "boom"})
+	if class != "zaprollbar.customError" {
+		t.Fatalf("expected the type name (stripped of its pointer *), got %q", class)
+	}
+}
+
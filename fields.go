@@ -0,0 +1,177 @@
+package zaprollbar
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// defaultRedactedHeaders lists the headers Request redacts unless told
+// otherwise, since they routinely carry credentials.
+var defaultRedactedHeaders = []string{"Authorization", "Cookie", "Set-Cookie"}
+
+// personField, requestField, contextField and fingerprintField are sentinel
+// types carried in a zapcore.Field's Interface. message looks for them by
+// type (not by Key) and routes them into Rollbar's dedicated data.person,
+// data.request, data.context and data.fingerprint slots instead of dumping
+// them into data.custom like an ordinary field.
+type personField struct {
+	id       string
+	username string
+	email    string
+}
+
+func (p personField) payload() map[string]interface{} {
+	return map[string]interface{}{
+		"id":       p.id,
+		"username": p.username,
+		"email":    p.email,
+	}
+}
+
+type requestField struct {
+	url     string
+	method  string
+	headers map[string]string
+	query   map[string]string
+	userIP  string
+}
+
+func (r requestField) payload() map[string]interface{} {
+	return map[string]interface{}{
+		"url":     r.url,
+		"method":  r.method,
+		"headers": r.headers,
+		"query":   r.query,
+		"user_ip": r.userIP,
+	}
+}
+
+type contextField struct {
+	value string
+}
+
+type fingerprintField struct {
+	value string
+}
+
+// Person returns a field that populates Rollbar's data.person.
+func Person(id, username, email string) zapcore.Field {
+	return zapcore.Field{
+		Key:       "person",
+		Type:      zapcore.ReflectType,
+		Interface: personField{id: id, username: username, email: email},
+	}
+}
+
+// Context returns a field that populates Rollbar's data.context, typically
+// a route name or job identifier describing where the log came from.
+func Context(value string) zapcore.Field {
+	return zapcore.Field{
+		Key:       "context",
+		Type:      zapcore.ReflectType,
+		Interface: contextField{value: value},
+	}
+}
+
+// Fingerprint returns a field that overrides the fingerprint Write would
+// otherwise derive from the logged error, forcing specific events to group
+// (or not group) together in the Rollbar UI.
+func Fingerprint(value string) zapcore.Field {
+	return zapcore.Field{
+		Key:       "fingerprint",
+		Type:      zapcore.ReflectType,
+		Interface: fingerprintField{value: value},
+	}
+}
+
+// RequestOption configures header handling for Request.
+type RequestOption func(*requestOptions)
+
+type requestOptions struct {
+	redact map[string]bool
+	allow  map[string]bool
+}
+
+// RedactHeaders adds header names (case-insensitive) to redact as
+// "[REDACTED]" in addition to the defaults (Authorization, Cookie,
+// Set-Cookie).
+func RedactHeaders(names ...string) RequestOption {
+	return func(o *requestOptions) {
+		for _, n := range names {
+			o.redact[http.CanonicalHeaderKey(n)] = true
+		}
+	}
+}
+
+// AllowHeaders restricts Request to only the named headers (case-insensitive),
+// dropping everything else instead of sending it to Rollbar.
+func AllowHeaders(names ...string) RequestOption {
+	return func(o *requestOptions) {
+		if o.allow == nil {
+			o.allow = make(map[string]bool, len(names))
+		}
+		for _, n := range names {
+			o.allow[http.CanonicalHeaderKey(n)] = true
+		}
+	}
+}
+
+// Request returns a field that populates Rollbar's data.request from req,
+// redacting sensitive headers before they're serialized.
+func Request(req *http.Request, opts ...RequestOption) zapcore.Field {
+	o := &requestOptions{redact: make(map[string]bool, len(defaultRedactedHeaders))}
+	for _, h := range defaultRedactedHeaders {
+		o.redact[http.CanonicalHeaderKey(h)] = true
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	headers := make(map[string]string, len(req.Header))
+	for k, v := range req.Header {
+		ck := http.CanonicalHeaderKey(k)
+		if o.allow != nil && !o.allow[ck] {
+			continue
+		}
+		if o.redact[ck] {
+			headers[ck] = "[REDACTED]"
+			continue
+		}
+		headers[ck] = strings.Join(v, ", ")
+	}
+
+	return zapcore.Field{
+		Key:  "request",
+		Type: zapcore.ReflectType,
+		Interface: requestField{
+			url:     req.URL.String(),
+			method:  req.Method,
+			headers: headers,
+			query:   flattenValues(req.URL.Query()),
+			userIP:  clientIP(req),
+		},
+	}
+}
+
+func flattenValues(values url.Values) map[string]string {
+	out := make(map[string]string, len(values))
+	for k, v := range values {
+		out[k] = strings.Join(v, ", ")
+	}
+	return out
+}
+
+func clientIP(req *http.Request) string {
+	if fwd := req.Header.Get("X-Forwarded-For"); fwd != "" {
+		return strings.TrimSpace(strings.Split(fwd, ",")[0])
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,86 @@
+package zaprollbar
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPersonPayload(t *testing.T) {
+	f := Person("1", "alice", "alice@example.com")
+	p, ok := f.Interface.(personField)
+	if !ok {
+		t.Fatalf("expected a personField, got %T", f.Interface)
+	}
+	payload := p.payload()
+	if payload["id"] != "1" || payload["username"] != "alice" || payload["email"] != "alice@example.com" {
+		t.Fatalf("unexpected payload: %v", payload)
+	}
+}
+
+func TestContextValue(t *testing.T) {
+	f := Context("checkout.process")
+	c, ok := f.Interface.(contextField)
+	if !ok {
+		t.Fatalf("expected a contextField, got %T", f.Interface)
+	}
+	if c.value != "checkout.process" {
+		t.Fatalf("expected %q, got %q", "checkout.process", c.value)
+	}
+}
+
+func newTestRequest(t *testing.T) *http.Request {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/path?q=1", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("X-Custom", "value")
+	req.RemoteAddr = "10.0.0.1:1234"
+	return req
+}
+
+func TestRequestRedactsDefaultHeaders(t *testing.T) {
+	f := Request(newTestRequest(t))
+	r, ok := f.Interface.(requestField)
+	if !ok {
+		t.Fatalf("expected a requestField, got %T", f.Interface)
+	}
+	if r.headers["Authorization"] != "[REDACTED]" {
+		t.Fatalf("expected Authorization to be redacted, got %q", r.headers["Authorization"])
+	}
+	if r.headers["X-Custom"] != "value" {
+		t.Fatalf("expected X-Custom to pass through, got %q", r.headers["X-Custom"])
+	}
+	if r.userIP != "10.0.0.1" {
+		t.Fatalf("expected userIP derived from RemoteAddr, got %q", r.userIP)
+	}
+}
+
+func TestRequestRedactHeadersOption(t *testing.T) {
+	f := Request(newTestRequest(t), RedactHeaders("X-Custom"))
+	r := f.Interface.(requestField)
+	if r.headers["X-Custom"] != "[REDACTED]" {
+		t.Fatalf("expected X-Custom to be redacted by RedactHeaders, got %q", r.headers["X-Custom"])
+	}
+}
+
+func TestRequestAllowHeadersOption(t *testing.T) {
+	f := Request(newTestRequest(t), AllowHeaders("X-Custom"))
+	r := f.Interface.(requestField)
+	if _, ok := r.headers["Authorization"]; ok {
+		t.Fatalf("expected Authorization to be dropped when not in AllowHeaders, got %v", r.headers)
+	}
+	if r.headers["X-Custom"] != "value" {
+		t.Fatalf("expected X-Custom to pass through as allowed, got %q", r.headers["X-Custom"])
+	}
+}
+
+func TestClientIPPrefersXForwardedFor(t *testing.T) {
+	req := newTestRequest(t)
+	req.Header.Set("X-Forwarded-For", "203.0.113.5, 10.0.0.1")
+
+	f := Request(req)
+	r := f.Interface.(requestField)
+	if r.userIP != "203.0.113.5" {
+		t.Fatalf("expected the first X-Forwarded-For entry, got %q", r.userIP)
+	}
+}
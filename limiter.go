@@ -0,0 +1,176 @@
+package zaprollbar
+
+import (
+	"container/list"
+	"fmt"
+	"hash/adler32"
+	"math"
+	"sync"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	defaultDedupWindow    = time.Minute
+	defaultDedupCacheSize = 1024
+	defaultRateLimit      = 50.0 // items/sec
+	defaultRateBurst      = 100
+)
+
+// suppressionKey derives a client-side dedup fingerprint from the level, the
+// error's class and topmost stack frame (class "message" and no frame when
+// there's no error), and an adler32 checksum of the message, the same
+// checksum getErrorClass uses for plain errors.New errors.
+func suppressionKey(ent zapcore.Entry, err error) string {
+	class := "message"
+	frame := ""
+	if err != nil {
+		class = getErrorClass(err)
+		if chains := getTraceChains(err); len(chains) > 0 {
+			if frames, ok := chains[0][0]["frames"].([]map[string]interface{}); ok && len(frames) > 0 {
+				frame = fmt.Sprintf("%v:%v", frames[0]["filename"], frames[0]["lineno"])
+			}
+		}
+	}
+	checksum := adler32.Checksum([]byte(ent.Message))
+	return fmt.Sprintf("%d|%s|%s|%x", ent.Level, class, frame, checksum)
+}
+
+// dedupEntry tracks one fingerprint's send state.
+type dedupEntry struct {
+	key        string
+	level      zapcore.Level
+	lastSent   time.Time
+	suppressed int
+}
+
+// dedupLimiter lets the first occurrence of a fingerprint through every
+// window and counts the rest, so a tight error loop collapses to one send
+// per window; flush reports what it suppressed so it can go out as a single
+// aggregated item instead of being silently dropped.
+type dedupLimiter struct {
+	mu      sync.Mutex
+	window  time.Duration
+	maxSize int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func newDedupLimiter(window time.Duration, maxSize int) *dedupLimiter {
+	return &dedupLimiter{
+		window:  window,
+		maxSize: maxSize,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// allow reports whether this occurrence of key should be sent now. When it
+// returns false, the occurrence was counted as suppressed instead.
+func (d *dedupLimiter) allow(ent zapcore.Entry, key string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	if el, ok := d.entries[key]; ok {
+		d.order.MoveToFront(el)
+		entry := el.Value.(*dedupEntry)
+		if now.Sub(entry.lastSent) < d.window {
+			entry.suppressed++
+			return false
+		}
+		entry.lastSent = now
+		entry.suppressed = 0
+		entry.level = ent.Level
+		return true
+	}
+
+	entry := &dedupEntry{key: key, level: ent.Level, lastSent: now}
+	el := d.order.PushFront(entry)
+	d.entries[key] = el
+	if d.order.Len() > d.maxSize {
+		oldest := d.order.Back()
+		if oldest != nil {
+			d.order.Remove(oldest)
+			delete(d.entries, oldest.Value.(*dedupEntry).key)
+		}
+	}
+	return true
+}
+
+// flush returns a snapshot of, and resets, every entry that suppressed at
+// least one occurrence since the last flush.
+func (d *dedupLimiter) flush() []dedupEntry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var flushed []dedupEntry
+	for _, el := range d.entries {
+		entry := el.Value.(*dedupEntry)
+		if entry.suppressed > 0 {
+			flushed = append(flushed, *entry)
+			entry.suppressed = 0
+		}
+	}
+	return flushed
+}
+
+// flushSuppressedLoop periodically reports what the dedup limiter dropped,
+// until c.stop is closed. A non-positive window means dedup.allow never
+// suppresses anything, so there's nothing to flush; time.NewTicker would
+// panic on such a value anyway, so just wait for stop instead.
+func (c *rollbarCore) flushSuppressedLoop() {
+	defer c.workerWG.Done()
+
+	if c.dedup.window <= 0 {
+		<-c.stop
+		return
+	}
+
+	ticker := time.NewTicker(c.dedup.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, e := range c.dedup.flush() {
+				c.enqueueSuppressedSummary(e)
+			}
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// tokenBucket caps delivery to a steady items/sec rate (with bursts up to
+// its capacity) so a logging storm can't overwhelm Rollbar.
+type tokenBucket struct {
+	mu       sync.Mutex
+	tokens   float64
+	capacity float64
+	rate     float64
+	last     time.Time
+}
+
+func newTokenBucket(ratePerSec float64, capacity int) *tokenBucket {
+	return &tokenBucket{
+		tokens:   float64(capacity),
+		capacity: float64(capacity),
+		rate:     ratePerSec,
+		last:     time.Now(),
+	}
+}
+
+func (b *tokenBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = math.Min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
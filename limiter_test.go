@@ -0,0 +1,73 @@
+package zaprollbar
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+func TestDedupLimiterSuppressesWithinWindow(t *testing.T) {
+	d := newDedupLimiter(time.Minute, 1024)
+	ent := zapcore.Entry{Level: zapcore.ErrorLevel}
+
+	if !d.allow(ent, "key") {
+		t.Fatal("expected the first occurrence to be allowed")
+	}
+	if d.allow(ent, "key") {
+		t.Fatal("expected a repeat within the window to be suppressed")
+	}
+
+	flushed := d.flush()
+	if len(flushed) != 1 || flushed[0].suppressed != 1 {
+		t.Fatalf("expected one flushed entry with suppressed=1, got %v", flushed)
+	}
+}
+
+func TestDedupLimiterAllowsAfterWindow(t *testing.T) {
+	d := newDedupLimiter(time.Millisecond, 1024)
+	ent := zapcore.Entry{Level: zapcore.ErrorLevel}
+
+	if !d.allow(ent, "key") {
+		t.Fatal("expected the first occurrence to be allowed")
+	}
+	time.Sleep(5 * time.Millisecond)
+	if !d.allow(ent, "key") {
+		t.Fatal("expected a repeat after the window elapsed to be allowed again")
+	}
+}
+
+func TestDedupLimiterZeroWindowNeverSuppresses(t *testing.T) {
+	d := newDedupLimiter(0, 1024)
+	ent := zapcore.Entry{Level: zapcore.ErrorLevel}
+
+	for i := 0; i < 3; i++ {
+		if !d.allow(ent, "key") {
+			t.Fatalf("expected a zero window to never suppress, occurrence %d was dropped", i)
+		}
+	}
+}
+
+func TestDedupLimiterEvictsOldestPastCacheSize(t *testing.T) {
+	d := newDedupLimiter(time.Minute, 2)
+	ent := zapcore.Entry{Level: zapcore.ErrorLevel}
+
+	d.allow(ent, "a")
+	d.allow(ent, "b")
+	d.allow(ent, "c") // evicts "a"
+
+	if !d.allow(ent, "a") {
+		t.Fatal("expected \"a\" to have been evicted and thus allowed again")
+	}
+}
+
+func TestTokenBucketCapsRate(t *testing.T) {
+	b := newTokenBucket(1, 1)
+
+	if !b.allow() {
+		t.Fatal("expected the first call to consume the initial burst token")
+	}
+	if b.allow() {
+		t.Fatal("expected a second immediate call to be rejected once the burst is spent")
+	}
+}
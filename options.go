@@ -0,0 +1,69 @@
+package zaprollbar
+
+import "time"
+
+// Option configures a rollbarCore built by NewRollbarCore.
+type Option func(*rollbarCore)
+
+// WithWorkers sets how many goroutines concurrently deliver items to Rollbar.
+func WithWorkers(n int) Option {
+	return func(c *rollbarCore) { c.workers = n }
+}
+
+// WithQueueSize sets how many marshaled items may be buffered awaiting
+// delivery before OnQueueFullPolicy kicks in.
+func WithQueueSize(n int) Option {
+	return func(c *rollbarCore) { c.queueSize = n }
+}
+
+// WithOnQueueFull sets what Write does when the delivery queue is full.
+func WithOnQueueFull(p OnQueueFullPolicy) Option {
+	return func(c *rollbarCore) { c.fullPolicy = p }
+}
+
+// WithMaxAttempts caps how many delivery attempts (the first send included)
+// a single item gets before being dropped.
+func WithMaxAttempts(n int) Option {
+	return func(c *rollbarCore) { c.maxAttempts = n }
+}
+
+// WithBackoff sets the initial and maximum retry backoff between attempts.
+func WithBackoff(base, max time.Duration) Option {
+	return func(c *rollbarCore) {
+		c.baseBackoff = base
+		c.maxBackoff = max
+	}
+}
+
+// WithDedupWindow sets how long a fingerprint is suppressed for after its
+// first occurrence is sent.
+func WithDedupWindow(d time.Duration) Option {
+	return func(c *rollbarCore) { c.dedupWindow = d }
+}
+
+// WithDedupCacheSize caps how many distinct fingerprints the dedup limiter
+// tracks at once, evicting the least recently seen.
+func WithDedupCacheSize(n int) Option {
+	return func(c *rollbarCore) { c.dedupCacheSize = n }
+}
+
+// WithRateLimit caps delivery to ratePerSec items/sec with bursts up to
+// burst items. A ratePerSec of 0 disables the cap.
+func WithRateLimit(ratePerSec float64, burst int) Option {
+	return func(c *rollbarCore) {
+		c.rateLimit = ratePerSec
+		c.rateBurst = burst
+	}
+}
+
+// WithEndpoint overrides the Rollbar item endpoint the default Transport
+// posts to. Ignored if WithTransport is also given.
+func WithEndpoint(url string) Option {
+	return func(c *rollbarCore) { c.endpoint = url }
+}
+
+// WithTransport replaces the default HTTP transport, e.g. with an in-memory
+// fake for tests or a SpoolTransport for durability across restarts.
+func WithTransport(t Transport) Option {
+	return func(c *rollbarCore) { c.transport = t }
+}
@@ -0,0 +1,216 @@
+package zaprollbar
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// errClosed is returned by enqueue once Close has been called: the workers
+// that would have read the item back out are already gone, so accepting it
+// would just leak an unmatched c.Add(1) and hang Sync forever.
+var errClosed = errors.New("zaprollbar: core closed")
+
+const (
+	defaultWorkers     = 4
+	defaultQueueSize   = 1000
+	defaultMaxAttempts = 5
+	defaultBaseBackoff = 250 * time.Millisecond
+	defaultMaxBackoff  = 30 * time.Second
+)
+
+// OnQueueFullPolicy controls what Write does when the delivery queue is
+// full, i.e. the workers aren't keeping up with the logging rate.
+type OnQueueFullPolicy int
+
+const (
+	// OnQueueFullBlock blocks the caller until there is room in the queue.
+	OnQueueFullBlock OnQueueFullPolicy = iota
+	// OnQueueFullDropOldest discards the oldest queued item to make room.
+	OnQueueFullDropOldest
+	// OnQueueFullDropNewest discards the item that just failed to enqueue.
+	OnQueueFullDropNewest
+	// OnQueueFullSample randomly keeps or drops the item that failed to
+	// enqueue, to shed load while still surfacing some events.
+	OnQueueFullSample
+)
+
+// startWorkers launches c.workers goroutines that own all network I/O for
+// this core, reading serialized items off c.queue, plus the background loop
+// that flushes the dedup limiter's suppressed-event summaries.
+func (c *rollbarCore) startWorkers() {
+	for i := 0; i < c.workers; i++ {
+		c.workerWG.Add(1)
+		go c.work()
+	}
+	c.workerWG.Add(1)
+	go c.flushSuppressedLoop()
+}
+
+// work drains c.queue until c.stop is closed, then drains whatever is left
+// in the queue before exiting so a Close doesn't strand queued items.
+func (c *rollbarCore) work() {
+	defer c.workerWG.Done()
+	for {
+		select {
+		case payload := <-c.queue:
+			c.deliver(payload)
+		case <-c.stop:
+			for {
+				select {
+				case payload := <-c.queue:
+					c.deliver(payload)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// enqueue hands payload to the delivery pipeline without blocking on network
+// I/O. It is the only thing Write does besides its dedup and rate checks and
+// marshaling.
+//
+// It refuses once Close has been called: the workers that would read the
+// item back off c.queue have already drained and exited by then, so pushing
+// onto c.queue would accept an item nothing will ever deliver, and the
+// matching c.Add(1) would never see a c.Done(), hanging Sync forever.
+func (c *rollbarCore) enqueue(payload []byte) error {
+	blocked, err := c.enqueueFast(payload)
+	if !blocked {
+		return err
+	}
+
+	// OnQueueFullBlock: the fast path found no room. This wait is outside
+	// closeMu (it can legitimately take a long time), but it's still race
+	// free: c.Add(1) already happened in enqueueFast, so either we get room
+	// and send, or c.stop closes and we call Done() to match. The send case
+	// can only still be selectable here because a worker is actively making
+	// room by reading c.queue; once Close stops the workers they read
+	// nothing further, so from that point on only the c.stop case is ever
+	// ready.
+	select {
+	case c.queue <- payload:
+	case <-c.stop:
+		c.Done()
+	}
+	return nil
+}
+
+// enqueueFast is the part of enqueue that must run atomically with Close:
+// checking c.stop, registering the delivery-tracking c.Add(1), and attempting
+// an immediate non-blocking send or OnQueueFullPolicy's non-blocking
+// handling. Holding c.closeMu's read side across all of that closes the race
+// where Close could close c.stop and let the workers drain c.queue and exit
+// in between the check and the push — see closeMu's doc on rollbarCore.
+//
+// It reports blocked=true when fullPolicy is OnQueueFullBlock and the fast
+// attempt found no room, so the caller can wait for room outside closeMu
+// without risking a deadlock against Close (which needs closeMu's write side
+// to proceed).
+func (c *rollbarCore) enqueueFast(payload []byte) (blocked bool, err error) {
+	c.closeMu.RLock()
+	defer c.closeMu.RUnlock()
+
+	select {
+	case <-c.stop:
+		return false, errClosed
+	default:
+	}
+
+	c.Add(1)
+	select {
+	case c.queue <- payload:
+		return false, nil
+	default:
+	}
+
+	switch c.fullPolicy {
+	case OnQueueFullDropOldest:
+		select {
+		case <-c.queue:
+			c.Done()
+		default:
+		}
+		select {
+		case c.queue <- payload:
+		default:
+			c.Done()
+		}
+	case OnQueueFullDropNewest:
+		c.Done()
+	case OnQueueFullSample:
+		if rand.Intn(2) == 0 {
+			select {
+			case c.queue <- payload:
+			default:
+				c.Done()
+			}
+		} else {
+			c.Done()
+		}
+	default: // OnQueueFullBlock
+		return true, nil
+	}
+	return false, nil
+}
+
+// deliver POSTs payload to Rollbar, retrying 5xx and 429 responses with
+// exponential backoff and jitter, honoring Rollbar's rate limit headers,
+// up to c.maxAttempts.
+func (c *rollbarCore) deliver(payload []byte) {
+	defer c.Done()
+
+	backoff := c.baseBackoff
+	for attempt := 1; attempt <= c.maxAttempts; attempt++ {
+		err := c.post(payload)
+		if err == nil {
+			return
+		}
+		if c.ctx.Err() != nil {
+			return
+		}
+
+		// A typed rollbarResponseError tells us whether Rollbar considers
+		// the failure retryable (5xx/429); anything else is a network-level
+		// error, which we also retry.
+		retryable := true
+		wait := backoff
+		if resp, ok := errors.Cause(err).(*rollbarResponseError); ok {
+			retryable = resp.retryable()
+			if resp.retryAfter > 0 {
+				wait = resp.retryAfter
+			}
+		}
+		if !retryable || attempt == c.maxAttempts {
+			return
+		}
+
+		time.Sleep(wait + jitter(wait))
+		backoff *= 2
+		if backoff > c.maxBackoff {
+			backoff = c.maxBackoff
+		}
+	}
+}
+
+// post hands payload to c.transport with a bounded, cancelable context:
+// cancelable so Close can abort in-flight deliveries, bounded so a hung
+// transport can't stall a worker forever.
+func (c *rollbarCore) post(payload []byte) error {
+	ctx, cancel := context.WithTimeout(c.ctx, rollbarTimeout)
+	defer cancel()
+	return c.transport.Send(ctx, payload)
+}
+
+// jitter returns a random duration in [0, d/2], so concurrent workers
+// retrying the same backoff don't all hammer Rollbar at once.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d)/2 + 1))
+}
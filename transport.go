@@ -0,0 +1,298 @@
+package zaprollbar
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/adler32"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Transport delivers a single marshaled Rollbar item. It's the seam that
+// makes rollbarCore testable without a real token or network access, and
+// what SpoolTransport wraps to survive process restarts.
+type Transport interface {
+	Send(ctx context.Context, payload []byte) error
+}
+
+// httpTransport is the default Transport, POSTing to a Rollbar-compatible
+// endpoint.
+type httpTransport struct {
+	client   *http.Client
+	endpoint string
+
+	// rateLimitedUntil is a UnixNano deadline before which we already know
+	// from a previous response's X-Rate-Limit-Remaining that Rollbar will
+	// reject us, so Send can refuse early instead of spending a request (and
+	// a 429) to find that out again.
+	rateLimitedUntil int64
+}
+
+func newHTTPTransport(endpoint string) *httpTransport {
+	return &httpTransport{client: &http.Client{}, endpoint: endpoint}
+}
+
+func (t *httpTransport) Send(ctx context.Context, payload []byte) error {
+	if until := atomic.LoadInt64(&t.rateLimitedUntil); until != 0 {
+		if d := time.Until(time.Unix(0, until)); d > 0 {
+			return &rollbarResponseError{status: http.StatusTooManyRequests, retryAfter: d}
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", t.endpoint, bytes.NewBuffer(payload))
+	if err != nil {
+		return errors.Wrap(err, "building rollbar request")
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "posting rollbar request")
+	}
+	defer resp.Body.Close()
+	t.noteRateLimit(resp.Header)
+	if resp.StatusCode != http.StatusOK {
+		return &rollbarResponseError{
+			status:     resp.StatusCode,
+			retryAfter: retryAfter(resp.Header),
+		}
+	}
+	return nil
+}
+
+// noteRateLimit records when X-Rate-Limit-Remaining has hit 0, so the next
+// Send can back off before spending a request on a guaranteed 429.
+func (t *httpTransport) noteRateLimit(h http.Header) {
+	remaining := h.Get("X-Rate-Limit-Remaining")
+	if remaining == "" {
+		return
+	}
+	n, err := strconv.Atoi(remaining)
+	if err != nil || n > 0 {
+		return
+	}
+	reset := h.Get("X-Rate-Limit-Reset")
+	epoch, err := strconv.ParseInt(reset, 10, 64)
+	if err != nil {
+		return
+	}
+	atomic.StoreInt64(&t.rateLimitedUntil, time.Unix(epoch, 0).UnixNano())
+}
+
+// rollbarResponseError records a non-200 Rollbar response, including
+// whatever Retry-After it sent back.
+type rollbarResponseError struct {
+	status     int
+	retryAfter time.Duration
+}
+
+func (e *rollbarResponseError) Error() string {
+	return fmt.Sprintf("expected 200 from rollbar but got %d", e.status)
+}
+
+func (e *rollbarResponseError) retryable() bool {
+	return e.status == http.StatusTooManyRequests || e.status >= http.StatusInternalServerError
+}
+
+// retryAfter reads Rollbar's Retry-After header, falling back to
+// X-Rate-Limit-Reset (seconds since epoch) when present instead.
+func retryAfter(h http.Header) time.Duration {
+	if ra := h.Get("Retry-After"); ra != "" {
+		if secs, err := strconv.Atoi(ra); err == nil {
+			return time.Duration(secs) * time.Second
+		}
+		if t, err := http.ParseTime(ra); err == nil {
+			if d := time.Until(t); d > 0 {
+				return d
+			}
+		}
+	}
+	if reset := h.Get("X-Rate-Limit-Reset"); reset != "" {
+		if epoch, err := strconv.ParseInt(reset, 10, 64); err == nil {
+			if d := time.Until(time.Unix(epoch, 0)); d > 0 {
+				return d
+			}
+		}
+	}
+	return 0
+}
+
+const (
+	defaultSpoolMaxFiles = 10000
+	// replayTimeout bounds how long NewSpoolTransport's startup replay may
+	// spend trying to flush a backlog before leaving the rest on disk for a
+	// later Replay call, so constructing a core can't hang forever
+	// because Rollbar is down and a previous run left a large backlog.
+	replayTimeout = 10 * time.Second
+)
+
+// SpoolTransport wraps another Transport and persists pending payloads to
+// disk before attempting delivery, so events survive a crash between being
+// queued and being delivered. On construction it replays whatever is
+// already in dir from a previous run.
+type SpoolTransport struct {
+	inner    Transport
+	dir      string
+	maxFiles int
+
+	mu    sync.Mutex
+	seq   uint64
+	files map[uint32]string // payload checksum -> spooled path, for in-flight retries
+}
+
+// NewSpoolTransport creates a SpoolTransport backed by dir, creating it if
+// necessary, and replays any items left over from a previous process.
+//
+// That startup replay is bounded by replayTimeout: whatever it doesn't get
+// through stays on disk for a later Replay call (Send only delivers its own
+// payload), so
+// a large backlog with Rollbar down can't stall construction indefinitely.
+func NewSpoolTransport(inner Transport, dir string, maxFiles int) (*SpoolTransport, error) {
+	if maxFiles <= 0 {
+		maxFiles = defaultSpoolMaxFiles
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, errors.Wrap(err, "creating spool directory")
+	}
+	s := &SpoolTransport{
+		inner:    inner,
+		dir:      dir,
+		maxFiles: maxFiles,
+		files:    make(map[uint32]string),
+	}
+	if err := s.loadFiles(); err != nil {
+		return nil, errors.Wrap(err, "scanning spool directory")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), replayTimeout)
+	defer cancel()
+	s.Replay(ctx)
+	return s, nil
+}
+
+// loadFiles populates s.files and s.seq from whatever is already spooled in
+// dir, so the maxFiles bound and sequence numbering carry over a restart
+// instead of resetting to empty.
+func (s *SpoolTransport) loadFiles() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		var seq uint64
+		var sum uint32
+		if _, err := fmt.Sscanf(e.Name(), "%020d-%08x.json", &seq, &sum); err != nil {
+			continue
+		}
+		s.files[sum] = filepath.Join(s.dir, e.Name())
+		if seq > s.seq {
+			s.seq = seq
+		}
+	}
+	return nil
+}
+
+// Send spools payload to disk, then attempts immediate delivery through the
+// wrapped transport. The spooled file is removed on success and left in
+// place (for Replay or the next process's constructor) on failure.
+func (s *SpoolTransport) Send(ctx context.Context, payload []byte) error {
+	path, err := s.spool(payload)
+	if err != nil {
+		return err
+	}
+	if err := s.inner.Send(ctx, payload); err != nil {
+		return err
+	}
+	s.forget(payload, path)
+	return nil
+}
+
+// Replay re-sends every payload currently spooled in dir, in the order they
+// were written, removing each on success. It stops early, leaving whatever
+// is left on disk for the next Replay call, if ctx is done first.
+func (s *SpoolTransport) Replay(ctx context.Context) error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return errors.Wrap(err, "reading spool directory")
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names) // monotonic filenames sort in write order
+
+	for _, name := range names {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		path := filepath.Join(s.dir, name)
+		payload, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if err := s.inner.Send(ctx, payload); err != nil {
+			continue
+		}
+		s.forget(payload, path)
+	}
+	return nil
+}
+
+func (s *SpoolTransport) spool(payload []byte) (string, error) {
+	sum := adler32.Checksum(payload)
+
+	s.mu.Lock()
+	if path, ok := s.files[sum]; ok {
+		s.mu.Unlock()
+		return path, nil
+	}
+	if len(s.files) >= s.maxFiles {
+		s.mu.Unlock()
+		return "", errors.New("rollbar spool directory is full")
+	}
+	seq := atomic.AddUint64(&s.seq, 1)
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d-%08x.json", seq, sum))
+	s.files[sum] = path
+	s.mu.Unlock()
+
+	if err := writeFileSynced(path, payload); err != nil {
+		return "", errors.Wrap(err, "spooling rollbar item")
+	}
+	return path, nil
+}
+
+func (s *SpoolTransport) forget(payload []byte, path string) {
+	os.Remove(path)
+	s.mu.Lock()
+	delete(s.files, adler32.Checksum(payload))
+	s.mu.Unlock()
+}
+
+// writeFileSynced writes payload to path and fsyncs it before returning, so
+// a crash right after Send can't lose data that was reported as spooled.
+func writeFileSynced(path string, payload []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(payload); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
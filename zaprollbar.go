@@ -1,16 +1,11 @@
 package zaprollbar
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"hash/adler32"
-	"net/http"
 	"os"
-	"reflect"
 	"runtime"
-	"strconv"
-	"strings"
 	"sync"
 	"time"
 
@@ -24,40 +19,138 @@ const (
 	rollbarTimeout  = time.Duration(10 * time.Second)
 )
 
-// NewRollbarCore returns a new rollbar zapcore.
+// MustRollbarCore returns a new rollbar zapcore with default tunables. It
+// panics if the hostname can't be determined. See NewRollbarCore to
+// configure workers, queue behavior, retries, dedup and rate limiting.
 func MustRollbarCore(env, token string) zapcore.Core {
+	return NewRollbarCore(env, token)
+}
+
+// NewRollbarCore returns a new rollbar zapcore, applying opts on top of the
+// package defaults. It panics if the hostname can't be determined.
+func NewRollbarCore(env, token string, opts ...Option) zapcore.Core {
 	hostname, err := os.Hostname()
 	if err != nil {
 		panic(err)
 	}
-	return &rollbarCore{
-		zapcore.ErrorLevel,
-		&http.Client{},
-		&sync.WaitGroup{},
-		make(map[string]interface{}),
-		env,
-		token,
-		rollbarEndpoint,
-		hostname,
+	c := &rollbarCore{
+		LevelEnabler: zapcore.ErrorLevel,
+		WaitGroup:    &sync.WaitGroup{},
+		fields:       make(map[string]interface{}),
+		env:          env,
+		token:        token,
+		endpoint:     rollbarEndpoint,
+		hostname:     hostname,
+
+		queueSize:   defaultQueueSize,
+		workers:     defaultWorkers,
+		fullPolicy:  OnQueueFullBlock,
+		maxAttempts: defaultMaxAttempts,
+		baseBackoff: defaultBaseBackoff,
+		maxBackoff:  defaultMaxBackoff,
+
+		dedupWindow:    defaultDedupWindow,
+		dedupCacheSize: defaultDedupCacheSize,
+		rateLimit:      defaultRateLimit,
+		rateBurst:      defaultRateBurst,
+
+		stop:      make(chan struct{}),
+		workerWG:  &sync.WaitGroup{},
+		closeOnce: &sync.Once{},
+		closeMu:   &sync.RWMutex{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	c.queue = make(chan []byte, c.queueSize)
+	c.dedup = newDedupLimiter(c.dedupWindow, c.dedupCacheSize)
+	if c.rateLimit > 0 {
+		c.bucket = newTokenBucket(c.rateLimit, c.rateBurst)
 	}
+	if c.transport == nil {
+		c.transport = newHTTPTransport(c.endpoint)
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+
+	c.startWorkers()
+	return c
 }
 
 // rollbarCore implements zapcore.Core
 type rollbarCore struct {
 	zapcore.LevelEnabler
-	*http.Client
 	*sync.WaitGroup
 	fields   map[string]interface{}
 	env      string
 	token    string
 	endpoint string
 	hostname string
+
+	// transport delivers marshaled items; swappable via WithTransport for
+	// tests or for durability (SpoolTransport).
+	transport Transport
+	ctx       context.Context
+	cancel    context.CancelFunc
+
+	// delivery pipeline: Write only marshals and enqueues, the workers below
+	// own every network call so logging never blocks on Rollbar.
+	queue       chan []byte
+	queueSize   int
+	workers     int
+	fullPolicy  OnQueueFullPolicy
+	maxAttempts int
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+
+	// client-side protection: dedup collapses a tight error loop down to
+	// one send per window, and bucket caps overall delivery rate.
+	dedupWindow    time.Duration
+	dedupCacheSize int
+	dedup          *dedupLimiter
+	rateLimit      float64
+	rateBurst      int
+	bucket         *tokenBucket
+
+	stop      chan struct{}
+	workerWG  *sync.WaitGroup
+	closeOnce *sync.Once
+
+	// closeMu serializes enqueue's fast (non-blocking) path against Close:
+	// enqueue holds the read side while it checks c.stop and attempts its
+	// non-blocking push, and Close takes the write side before closing
+	// c.stop. That guarantees any such push happens strictly before the
+	// workers can observe c.stop closed and run their final drain, so
+	// nothing can land in the queue after the workers have already stopped
+	// reading it. See enqueueFast in queue.go.
+	closeMu *sync.RWMutex
 }
 
-// With is a no-op.
-// XXX DONT USE IT
+// With returns a new core with fs merged into the core's accumulated fields,
+// following the usual zap pattern of carrying contextual fields through to
+// every subsequent Write call.
 func (c *rollbarCore) With(fs []zapcore.Field) zapcore.Core {
-	return c
+	clone := *c
+	clone.fields = mergeFields(c.fields, fs)
+	return &clone
+}
+
+// mergeFields resolves fs with a zapcore.MapObjectEncoder and layers the
+// result on top of a copy of base, so callers get back a map with the
+// original's values alongside the new ones.
+func mergeFields(base map[string]interface{}, fs []zapcore.Field) map[string]interface{} {
+	merged := make(map[string]interface{}, len(base)+len(fs))
+	for k, v := range base {
+		merged[k] = v
+	}
+	enc := zapcore.NewMapObjectEncoder()
+	for _, f := range fs {
+		f.AddTo(enc)
+	}
+	for k, v := range enc.Fields {
+		merged[k] = v
+	}
+	return merged
 }
 
 // Check determines whether or not a zapcore.Entry should write for a given level entry.
@@ -68,8 +161,81 @@ func (c *rollbarCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcor
 	return ce
 }
 
-// Write posts an error message to rollbar.
+// Write marshals ent and fs into a Rollbar item and hands it to the delivery
+// pipeline. It never performs network I/O itself, so it never blocks the
+// caller on Rollbar being slow or down.
+//
+// Before that, it checks the dedup limiter and rate limiter: a repeat of a
+// fingerprint already sent within the dedup window, or a send over the
+// configured rate, is dropped here (the dedup limiter flushes an aggregated
+// summary for what it drops, out of band).
 func (c *rollbarCore) Write(ent zapcore.Entry, fs []zapcore.Field) error {
+	if !c.dedup.allow(ent, suppressionKey(ent, findError(fs))) {
+		return nil
+	}
+	if c.bucket != nil && !c.bucket.allow() {
+		return nil
+	}
+
+	b, err := json.Marshal(c.message(ent, fs))
+	if err != nil {
+		return errors.Wrap(err, "marshalling rollbar post body to json")
+	}
+	return c.enqueue(b)
+}
+
+// findError returns the first field holding an error, or nil.
+func findError(fs []zapcore.Field) error {
+	for _, f := range fs {
+		if e, ok := f.Interface.(error); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+// enqueueSuppressedSummary builds and enqueues an aggregated item reporting
+// how many occurrences of e.key were suppressed by the dedup limiter.
+func (c *rollbarCore) enqueueSuppressedSummary(e dedupEntry) {
+	level := "error"
+	if e.level > zapcore.ErrorLevel {
+		level = "critical"
+	}
+	message := map[string]interface{}{
+		"access_token": c.token,
+		"data": map[string]interface{}{
+			"uuid":      fmt.Sprintf("%x", uuid.NewV4().Bytes()),
+			"level":     level,
+			"timestamp": time.Now(),
+			"platform":  runtime.GOOS,
+			"server": map[string]string{
+				"host": c.hostname,
+			},
+			"language":    "go",
+			"environment": c.env,
+			"body": map[string]interface{}{
+				"message": map[string]string{
+					"body": fmt.Sprintf("suppressed %d duplicate events", e.suppressed),
+				},
+			},
+			"custom": map[string]interface{}{
+				"suppressed_count": e.suppressed,
+			},
+			"fingerprint": e.key,
+			"notifier": map[string]string{
+				"name": "zaprollbar",
+			},
+		},
+	}
+	b, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+	c.enqueue(b)
+}
+
+// message builds the Rollbar item payload for ent and fs.
+func (c *rollbarCore) message(ent zapcore.Entry, fs []zapcore.Field) map[string]interface{} {
 	var body map[string]interface{}
 	level := "error"
 	if ent.Level > zapcore.ErrorLevel {
@@ -77,12 +243,60 @@ func (c *rollbarCore) Write(ent zapcore.Entry, fs []zapcore.Field) error {
 	}
 
 	var err error
+	var person, request map[string]interface{}
+	var contextValue string
+	var fp string
+	custom := zapcore.NewMapObjectEncoder()
+
+	// route routes fields with one of our sentinel Interface types to their
+	// dedicated Rollbar slot instead of data.custom. Reports whether it
+	// recognized v.
+	route := func(v interface{}) bool {
+		switch t := v.(type) {
+		case personField:
+			person = t.payload()
+		case requestField:
+			request = t.payload()
+		case contextField:
+			contextValue = t.value
+		case fingerprintField:
+			fp = t.value
+		default:
+			return false
+		}
+		return true
+	}
+
+	for k, v := range c.fields {
+		if route(v) {
+			continue
+		}
+		custom.Fields[k] = v
+	}
 	for _, f := range fs {
-		if e, ok := f.Interface.(error); ok {
+		if e, ok := f.Interface.(error); ok && err == nil {
 			err = e
-			break
+			continue
 		}
+		if route(f.Interface) {
+			continue
+		}
+		f.AddTo(custom)
+	}
+	if ent.LoggerName != "" {
+		custom.Fields["logger"] = ent.LoggerName
+	}
+	if ent.Caller.Defined {
+		custom.Fields["caller"] = map[string]interface{}{
+			"file":     ent.Caller.File,
+			"line":     ent.Caller.Line,
+			"function": ent.Caller.Function,
+		}
+	}
+	if ent.Stack != "" {
+		custom.Fields["stack"] = ent.Stack
 	}
+
 	if err == nil {
 		body = map[string]interface{}{
 			"message": map[string]string{
@@ -95,111 +309,77 @@ func (c *rollbarCore) Write(ent zapcore.Entry, fs []zapcore.Field) error {
 				"body": fmt.Sprintf("%+v", err),
 			},
 		}
-		trace := getTraceChain(err)
-		if len(trace) > 0 {
+		chains := getTraceChains(err)
+		if len(chains) > 0 {
 			body = map[string]interface{}{
-				"trace_chain": getTraceChain(err),
+				"trace_chain": chains[0],
+			}
+			if len(chains) > 1 {
+				custom.Fields["trace_chains"] = chains
 			}
 		}
+		if fp == "" {
+			fp = fingerprint(err)
+		}
 	}
-	message := map[string]interface{}{
-		"access_token": c.token,
-		"data": map[string]interface{}{
-			"uuid":      fmt.Sprintf("%x", uuid.NewV4().Bytes()),
-			"level":     level,
-			"timestamp": ent.Time,
-			"platform":  runtime.GOOS,
-			"server": map[string]string{
-				"host": c.hostname,
-			},
-			"language":    "go",
-			"environment": c.env,
-			"body":        body,
-			"notifier": map[string]string{
-				"name": ent.LoggerName,
-			},
+	data := map[string]interface{}{
+		"uuid":      fmt.Sprintf("%x", uuid.NewV4().Bytes()),
+		"level":     level,
+		"timestamp": ent.Time,
+		"platform":  runtime.GOOS,
+		"server": map[string]string{
+			"host": c.hostname,
+		},
+		"language":    "go",
+		"environment": c.env,
+		"body":        body,
+		"custom":      custom.Fields,
+		"notifier": map[string]string{
+			"name": ent.LoggerName,
 		},
 	}
-
-	// add 1 to waitgroup so we can wait until all requests have finished with Sync()
-	c.Add(1)
-	defer c.Done()
-
-	b, err := json.Marshal(message)
-	if err != nil {
-		return errors.Wrap(err, "marshalling rollbar post body to json")
+	if fp != "" {
+		data["fingerprint"] = fp
 	}
-
-	req, err := http.NewRequest("POST", c.endpoint, bytes.NewBuffer(b))
-	resp, err := c.Do(req)
-	if err != nil {
-		return errors.Wrap(err, "posting rollbar request")
+	if person != nil {
+		data["person"] = person
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return errors.Errorf("expected 200 from rollbar but got %s", resp.Status)
+	if request != nil {
+		data["request"] = request
+	}
+	if contextValue != "" {
+		data["context"] = contextValue
+	}
+	return map[string]interface{}{
+		"access_token": c.token,
+		"data":         data,
 	}
-	return nil
 }
 
-// Sync is a no-op.
+// Sync blocks until every enqueued item has been delivered (or exhausted its
+// retries), draining the queue rather than just waiting on whatever was
+// in-flight when Sync was called.
 func (c *rollbarCore) Sync() error {
 	c.Wait()
 	return nil
 }
 
-func getTrace(err error) map[string]interface{} {
-	type stackTracer interface {
-		StackTrace() errors.StackTrace
-	}
-
-	frames := []map[string]interface{}{}
-	if tracer, ok := err.(stackTracer); ok {
-		stack := tracer.StackTrace()
-		frames = make([]map[string]interface{}, len(stack))
-		for n, frame := range stack {
-			lineno, _ := strconv.Atoi(fmt.Sprintf("%d", frame)) // use zero on failure
-			methodFmt := "%n"                                   // broken out to trick govet
-			frames[n] = map[string]interface{}{
-				"filename": fmt.Sprintf("%s", frame),
-				"lineno":   lineno,
-				"method":   fmt.Sprintf(methodFmt, frame),
-			}
-		}
-	}
-	return map[string]interface{}{
-		"frames": frames,
-		"exception": map[string]interface{}{
-			"class":   getErrorClass(err),
-			"message": err.Error(),
-		},
-	}
-}
-
-func getErrorClass(err error) string {
-	class := reflect.TypeOf(err).String()
-	if class == "" {
-		return "panic"
-	} else if class == "*errors.errorString" || class == "*errors.fundamental" {
-		checksum := adler32.Checksum([]byte(err.Error()))
-		return fmt.Sprintf("{%x}", checksum)
-	}
-	return strings.TrimPrefix(class, "*")
+// Close signals the delivery workers to stop and at once cancels their
+// context, so an in-flight Transport.Send aborts rather than running out its
+// full timeout. The workers still hand every item left in the queue to the
+// transport, but with that canceled context, so a transport that honors ctx
+// does not deliver them. It does not accept newly enqueued items afterwards.
+func (c *rollbarCore) Close() error {
+	c.closeOnce.Do(func() {
+		// Block until any enqueue already past its c.stop check has finished
+		// pushing onto c.queue, so that push happens-before workers observe
+		// c.stop closed and run their final drain; see closeMu's doc.
+		c.closeMu.Lock()
+		close(c.stop)
+		c.closeMu.Unlock()
+		c.cancel()
+	})
+	c.workerWG.Wait()
+	return nil
 }
 
-func getTraceChain(err error) []map[string]interface{} {
-	type causer interface {
-		Cause() error
-	}
-
-	chain := []map[string]interface{}{}
-	for err != nil {
-		chain = append(chain, getTrace(err))
-		if errCauser, ok := err.(causer); ok {
-			err = errCauser.Cause()
-		} else {
-			err = nil
-		}
-	}
-	return chain
-}
@@ -1,8 +1,14 @@
 package zaprollbar
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -26,3 +32,188 @@ func TestRollbarCore(t *testing.T) {
 	logger := zap.New(core)
 	defer logger.Sync()
 }
+
+// fakeTransport records every payload handed to it instead of making a
+// network call, so tests don't need a real Rollbar token.
+type fakeTransport struct {
+	mu       sync.Mutex
+	payloads [][]byte
+}
+
+func (f *fakeTransport) Send(ctx context.Context, payload []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.payloads = append(f.payloads, payload)
+	return nil
+}
+
+func (f *fakeTransport) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.payloads)
+}
+
+func (f *fakeTransport) all() [][]byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]byte(nil), f.payloads...)
+}
+
+func TestRollbarCoreWithFakeTransport(t *testing.T) {
+	transport := &fakeTransport{}
+	core := NewRollbarCore("test", "token", WithTransport(transport))
+	logger := zap.New(core)
+
+	logger.Error("boom")
+	if err := logger.Sync(); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+
+	if got := transport.count(); got != 1 {
+		t.Fatalf("expected 1 delivered payload, got %d", got)
+	}
+}
+
+func TestWithMergesFieldsWithoutMutatingParent(t *testing.T) {
+	core := NewRollbarCore("test", "token", WithTransport(&fakeTransport{})).(*rollbarCore)
+	defer core.Close()
+
+	child := core.With([]zapcore.Field{{Key: "request_id", Type: zapcore.StringType, String: "abc"}}).(*rollbarCore)
+	if len(core.fields) != 0 {
+		t.Fatalf("expected With to leave the parent's fields untouched, got %v", core.fields)
+	}
+	if child.fields["request_id"] != "abc" {
+		t.Fatalf("expected child to carry request_id, got %v", child.fields)
+	}
+
+	grandchild := child.With([]zapcore.Field{{Key: "extra", Type: zapcore.StringType, String: "x"}}).(*rollbarCore)
+	if len(child.fields) != 1 {
+		t.Fatalf("expected With on child to leave child's own fields untouched, got %v", child.fields)
+	}
+	if grandchild.fields["request_id"] != "abc" || grandchild.fields["extra"] != "x" {
+		t.Fatalf("expected grandchild to carry both ancestors' fields, got %v", grandchild.fields)
+	}
+}
+
+func TestWithFieldsReachTheRollbarPayload(t *testing.T) {
+	transport := &fakeTransport{}
+	core := NewRollbarCore("test", "token", WithTransport(transport)).(*rollbarCore)
+
+	child := core.With([]zapcore.Field{{Key: "request_id", Type: zapcore.StringType, String: "abc"}}).(*rollbarCore)
+	logger := zap.New(child)
+	logger.Error("boom")
+	if err := logger.Sync(); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+
+	var decoded struct {
+		Data struct {
+			Custom map[string]interface{} `json:"custom"`
+		} `json:"data"`
+	}
+	payloads := transport.all()
+	if len(payloads) != 1 {
+		t.Fatalf("expected 1 delivered payload, got %d", len(payloads))
+	}
+	if err := json.Unmarshal(payloads[0], &decoded); err != nil {
+		t.Fatalf("unmarshal payload: %v", err)
+	}
+	if decoded.Data.Custom["request_id"] != "abc" {
+		t.Fatalf("expected request_id to reach data.custom, got %v", decoded.Data.Custom)
+	}
+}
+
+// TestSyncDoesNotDeadlockAfterConcurrentClose guards against a race where a
+// Write landing in c.queue right as Close runs could leave its c.Add(1)
+// unmatched forever: the workers would have already drained and exited, so
+// nothing ever calls the matching Done(), and Sync (c.Wait()) hangs.
+func TestSyncDoesNotDeadlockAfterConcurrentClose(t *testing.T) {
+	core := NewRollbarCore("test", "token", WithTransport(&fakeTransport{})).(*rollbarCore)
+	logger := zap.New(core)
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					logger.Error("boom")
+				}
+			}
+		}()
+	}
+
+	if err := core.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	close(stop)
+	wg.Wait()
+
+	done := make(chan error, 1)
+	go func() { done <- core.Sync() }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Sync: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Sync did not return: a Write likely raced past Close and left an unmatched Add(1)")
+	}
+}
+
+func TestWithDedupWindowZeroDoesNotPanic(t *testing.T) {
+	transport := &fakeTransport{}
+	core := NewRollbarCore("test", "token", WithTransport(transport), WithDedupWindow(0))
+	logger := zap.New(core)
+
+	logger.Error("boom")
+	logger.Error("boom")
+	if err := logger.Sync(); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if err := core.(*rollbarCore).Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if got := transport.count(); got != 2 {
+		t.Fatalf("expected dedup window 0 to suppress nothing, got %d delivered payloads", got)
+	}
+}
+
+// transportFunc adapts a plain function to the Transport interface.
+type transportFunc func(ctx context.Context, payload []byte) error
+
+func (f transportFunc) Send(ctx context.Context, payload []byte) error {
+	return f(ctx, payload)
+}
+
+func TestSpoolTransportReplaysPendingItems(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "spool")
+
+	alwaysFails := transportFunc(func(ctx context.Context, payload []byte) error {
+		return errors.New("rollbar unreachable")
+	})
+	spool, err := NewSpoolTransport(alwaysFails, dir, 0)
+	if err != nil {
+		t.Fatalf("NewSpoolTransport: %v", err)
+	}
+	if err := spool.Send(context.Background(), []byte(`{"id":1}`)); err == nil {
+		t.Fatal("expected the wrapped transport's error to propagate")
+	}
+
+	// a fresh SpoolTransport over the same directory should replay the item
+	// that never made it off disk.
+	ok := &fakeTransport{}
+	if _, err := NewSpoolTransport(ok, dir, 0); err != nil {
+		t.Fatalf("NewSpoolTransport: %v", err)
+	}
+	if got := ok.count(); got != 1 {
+		t.Fatalf("expected the spooled item to replay once, got %d", got)
+	}
+}